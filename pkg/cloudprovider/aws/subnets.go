@@ -17,66 +17,722 @@ package aws
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
-	"github.com/patrickmn/go-cache"
+	"github.com/prometheus/client_golang/prometheus"
 	"go.uber.org/zap"
 )
 
+// ErrCodeInsufficientFreeAddressesInSubnet is returned by EC2 when a launch into a subnet fails
+// because it has run out of free IPv4 addresses.
+const ErrCodeInsufficientFreeAddressesInSubnet = "InsufficientFreeAddressesInSubnet"
+
+// DefaultLowAvailableIPAddressThreshold is the AvailableIpAddressCount below which Get() emits a
+// warning, absent an explicit threshold on the Constraints, so operators can notice a subnet is
+// close to exhaustion before it starts failing launches.
+const DefaultLowAvailableIPAddressThreshold = 5
+
+var (
+	subnetLowIPAddressCount = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "karpenter",
+			Subsystem: "subnet",
+			Name:      "low_available_ip_address_count",
+			Help:      "Subnets whose AvailableIpAddressCount has dropped below the configured low-address threshold, labeled by subnet id.",
+		},
+		[]string{"subnet_id", "availability_zone"},
+	)
+	subnetCacheHits = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "karpenter",
+			Subsystem: "subnet",
+			Name:      "cache_hits_total",
+			Help:      "Count of SubnetProvider.Get calls served from the in-memory index versus requiring a synchronous refresh.",
+		},
+		[]string{"hit"},
+	)
+	subnetRefreshDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: "karpenter",
+			Subsystem: "subnet",
+			Name:      "refresh_duration_seconds",
+			Help:      "Time spent reconciling the in-memory subnet index against DescribeSubnets.",
+		},
+	)
+	subnetLastRefreshTimestamp = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "karpenter",
+			Subsystem: "subnet",
+			Name:      "last_successful_refresh_timestamp_seconds",
+			Help:      "Unix timestamp of the last successful subnet index refresh, labeled by cluster.",
+		},
+		[]string{"cluster"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(subnetLowIPAddressCount, subnetCacheHits, subnetRefreshDuration, subnetLastRefreshTimestamp)
+}
+
+// SubnetSelectionPolicy controls how Get() resolves ties when more than one subnet matches a
+// given AvailabilityZone.
+type SubnetSelectionPolicy string
+
+const (
+	// SubnetSelectionPolicyAll returns every matching subnet, spreading launches across all of them.
+	SubnetSelectionPolicyAll SubnetSelectionPolicy = "All"
+	// SubnetSelectionPolicyOnePerAZ returns a single, deterministically tie-broken subnet per AZ.
+	SubnetSelectionPolicyOnePerAZ SubnetSelectionPolicy = "OnePerAZ"
+)
+
+// RoleTagKey marks a subnet as preferred for a particular role, e.g. internal load balancers.
+const RoleTagKey = "kubernetes.io/role/internal-elb"
+
+// DiscoveryRoleTagKey is the Karpenter-specific equivalent of RoleTagKey.
+const DiscoveryRoleTagKey = "karpenter.sh/discovery/role"
+
+// ZoneType distinguishes a standard AvailabilityZone from the specialized EC2 zone types that
+// have their own instance type, networking, and connectivity restrictions.
+type ZoneType string
+
+const (
+	ZoneTypeAvailabilityZone ZoneType = "availability-zone"
+	ZoneTypeLocalZone        ZoneType = "local-zone"
+	ZoneTypeWavelengthZone   ZoneType = "wavelength-zone"
+	ZoneTypeOutpost          ZoneType = "outpost"
+)
+
+// Subnet wraps an ec2.Subnet with Karpenter-derived metadata so callers don't have to re-query
+// DescribeAvailabilityZones themselves to learn how to launch into it.
+type Subnet struct {
+	*ec2.Subnet
+	// ZoneType is the EC2 zone type of AvailabilityZone, sourced from DescribeAvailabilityZones.
+	ZoneType ZoneType
+	// RequiresCarrierIP is true when this subnet is in a Wavelength zone, where instances must
+	// request a carrier IP instead of a public IP to be externally reachable.
+	RequiresCarrierIP bool
+}
+
+// subnetIndex is an in-memory snapshot of one cluster's subnets, keyed by SubnetId with secondary
+// indexes by AvailabilityZone and by tag. Once populated, Get() serves from it without a
+// synchronous EC2 call; only the first Get() for a cluster or selection populates it synchronously.
+type subnetIndex struct {
+	bySubnetID map[string]*Subnet
+	byAZ       map[string][]*Subnet
+	byTag      map[string][]*Subnet
+}
+
+func newSubnetIndex(subnets []*Subnet) *subnetIndex {
+	index := &subnetIndex{
+		bySubnetID: map[string]*Subnet{},
+		byAZ:       map[string][]*Subnet{},
+		byTag:      map[string][]*Subnet{},
+	}
+	for _, subnet := range subnets {
+		index.bySubnetID[aws.StringValue(subnet.SubnetId)] = subnet
+		az := aws.StringValue(subnet.AvailabilityZone)
+		index.byAZ[az] = append(index.byAZ[az], subnet)
+		for _, tag := range subnet.Tags {
+			key := tagIndexKey(aws.StringValue(tag.Key), aws.StringValue(tag.Value))
+			index.byTag[key] = append(index.byTag[key], subnet)
+		}
+	}
+	return index
+}
+
+// all returns every indexed subnet in a deterministic, SubnetId-sorted order. Map iteration order
+// is randomized per call, and the stable capacity ranking in filterAndRank keeps equally-free
+// subnets in input order, so it depends on a stable input ordering to produce the same winner
+// every time. onePerAZ's per-AZ winner does not depend on input order, since subnetLess always
+// ends on SubnetId.
+func (i *subnetIndex) all() []*Subnet {
+	subnets := make([]*Subnet, 0, len(i.bySubnetID))
+	for _, subnet := range i.bySubnetID {
+		subnets = append(subnets, subnet)
+	}
+	sort.Slice(subnets, func(a, b int) bool {
+		return aws.StringValue(subnets[a].SubnetId) < aws.StringValue(subnets[b].SubnetId)
+	})
+	return subnets
+}
+
+func tagIndexKey(key, value string) string {
+	return key + "=" + value
+}
+
+// explicitKind distinguishes the two ways a Get() call can bypass tag-based discovery.
+type explicitKind int
+
+const (
+	explicitKindIDs explicitKind = iota
+	explicitKindNames
+)
+
+// explicitSelection remembers how to re-fetch a Get() call that bypassed tag-based discovery (an
+// explicit SubnetId or Name list), so the background refresh loop keeps it indexed too, the same
+// as tag-discovered clusters.
+type explicitSelection struct {
+	provisioner *v1alpha1.Provisioner
+	kind        explicitKind
+	values      []*string
+}
+
+// explicitIndexKey builds the indexes/explicit map key for an explicit SubnetId or Name selection,
+// namespaced by cluster so the same id list on two clusters doesn't collide.
+func explicitIndexKey(clusterName string, kind explicitKind, values []*string) string {
+	strs := make([]string, len(values))
+	for i, v := range values {
+		strs[i] = aws.StringValue(v)
+	}
+	sort.Strings(strs)
+	return fmt.Sprintf("explicit/%s/%d/%s", clusterName, kind, strings.Join(strs, ","))
+}
+
+// SubnetProvider serves Get() entirely from an in-memory index that a background goroutine keeps
+// reconciled against EC2, rather than making a synchronous DescribeSubnets call on every request
+// path miss.
 type SubnetProvider struct {
 	ec2api ec2iface.EC2API
-	cache  *cache.Cache
+
+	mu           sync.RWMutex
+	indexes      map[string]*subnetIndex // keyed by cluster name, or by explicitIndexKey for explicit selections
+	provisioners map[string]*v1alpha1.Provisioner
+	explicit     map[string]*explicitSelection
+	zoneTypes    map[string]ZoneType
+
+	refreshInterval time.Duration
+	stopCh          chan struct{}
 }
 
 func NewSubnetProvider(ec2api ec2iface.EC2API) *SubnetProvider {
-	return &SubnetProvider{
-		ec2api: ec2api,
-		cache:  cache.New(CacheTTL, CacheCleanupInterval),
+	s := &SubnetProvider{
+		ec2api:          ec2api,
+		indexes:         map[string]*subnetIndex{},
+		provisioners:    map[string]*v1alpha1.Provisioner{},
+		explicit:        map[string]*explicitSelection{},
+		refreshInterval: CacheTTL,
+		stopCh:          make(chan struct{}),
 	}
+	go s.run()
+	return s
 }
 
-func (s *SubnetProvider) Get(ctx context.Context, provisioner *v1alpha1.Provisioner, constraints *Constraints) ([]*ec2.Subnet, error) {
-	// 1. Get all viable subnets for this provisioner
-	subnets, err := s.getSubnets(ctx, provisioner)
+// run periodically reconciles every known provisioner's subnet index against EC2 until Close is
+// called.
+func (s *SubnetProvider) run() {
+	ticker := time.NewTicker(s.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.refreshAll(context.Background())
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// refreshAll is invoked once per background tick. It reconciles the zone-type mapping exactly
+// once for the whole tick (DescribeAvailabilityZones isn't cluster-scoped), then reconciles every
+// known cluster's subnet index against it.
+func (s *SubnetProvider) refreshAll(ctx context.Context) {
+	if _, err := s.refreshZoneTypes(ctx); err != nil {
+		zap.S().Errorf("Refreshing availability zone types, %v", err)
+	}
+	s.mu.RLock()
+	clusterNames := make([]string, 0, len(s.provisioners))
+	for name := range s.provisioners {
+		clusterNames = append(clusterNames, name)
+	}
+	explicitKeys := make([]string, 0, len(s.explicit))
+	for key := range s.explicit {
+		explicitKeys = append(explicitKeys, key)
+	}
+	s.mu.RUnlock()
+	for _, clusterName := range clusterNames {
+		if err := s.Refresh(ctx, clusterName); err != nil {
+			zap.S().Errorf("Refreshing subnets for cluster %s, %v", clusterName, err)
+		}
+	}
+	for _, key := range explicitKeys {
+		if err := s.refreshExplicit(ctx, key); err != nil {
+			zap.S().Errorf("Refreshing explicit subnet selection %s, %v", key, err)
+		}
+	}
+}
+
+// Close stops the background refresh goroutine.
+func (s *SubnetProvider) Close() {
+	close(s.stopCh)
+}
+
+// Refresh forces an immediate, synchronous reconciliation of a cluster's subnet index against
+// EC2. Callers invoke this after a scheduling failure (e.g. InsufficientFreeAddressesInSubnet) so
+// the next attempt routes around stale data instead of waiting for the next background tick. It
+// reuses the cached zone-type mapping rather than re-fetching it, since DescribeAvailabilityZones
+// is reconciled once per tick by refreshAll, not once per cluster.
+func (s *SubnetProvider) Refresh(ctx context.Context, clusterName string) error {
+	start := time.Now()
+	output, err := s.ec2api.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{{
+		Name:   aws.String("tag-key"), // Subnets must be tagged for the cluster
+		Values: []*string{aws.String(fmt.Sprintf(ClusterTagKeyFormat, clusterName))},
+	}}})
+	if err != nil {
+		return fmt.Errorf("describing subnets, %w", err)
+	}
+	zoneTypes, err := s.getZoneTypes(ctx)
+	if err != nil {
+		return err
+	}
+	index := newSubnetIndex(wrapSubnets(output.Subnets, zoneTypes))
+
+	s.mu.Lock()
+	s.indexes[clusterName] = index
+	s.mu.Unlock()
+
+	subnetRefreshDuration.Observe(time.Since(start).Seconds())
+	subnetLastRefreshTimestamp.WithLabelValues(clusterName).Set(float64(start.Unix()))
+	zap.S().Debugf("Refreshed %d subnets for cluster %s", len(index.bySubnetID), clusterName)
+	return nil
+}
+
+// getExplicit serves an explicit SubnetId or Name list (constraints.GetSubnetIds/GetSubnetNames)
+// from the same in-memory index as tag-based discovery, populating it synchronously on first use
+// and registering it with refreshAll so later requests for the same list never need a synchronous
+// DescribeSubnets call.
+func (s *SubnetProvider) getExplicit(ctx context.Context, provisioner *v1alpha1.Provisioner, kind explicitKind, values []*string) ([]*Subnet, error) {
+	key := explicitIndexKey(provisioner.Spec.Cluster.Name, kind, values)
+	s.mu.Lock()
+	s.explicit[key] = &explicitSelection{provisioner: provisioner, kind: kind, values: values}
+	s.mu.Unlock()
+
+	index, ok := s.getIndex(key)
+	if !ok {
+		subnetCacheHits.WithLabelValues("false").Inc()
+		if err := s.refreshExplicit(ctx, key); err != nil {
+			return nil, err
+		}
+		index, _ = s.getIndex(key)
+	} else {
+		subnetCacheHits.WithLabelValues("true").Inc()
+	}
+	return index.all(), nil
+}
+
+// refreshExplicit re-resolves a single explicit SubnetId or Name selection and stores the result
+// under its explicitIndexKey, mirroring Refresh's cluster-keyed reconciliation.
+func (s *SubnetProvider) refreshExplicit(ctx context.Context, key string) error {
+	s.mu.RLock()
+	selection, ok := s.explicit[key]
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	zoneTypes, err := s.getZoneTypes(ctx)
+	if err != nil {
+		return err
+	}
+	var subnets []*Subnet
+	switch selection.kind {
+	case explicitKindIDs:
+		subnets, err = s.getSubnetsByIds(ctx, selection.provisioner, selection.values, zoneTypes)
+	case explicitKindNames:
+		subnets, err = s.getSubnetsByNames(ctx, selection.provisioner, selection.values, zoneTypes)
+	}
 	if err != nil {
-		return nil, err
+		return err
+	}
+	s.mu.Lock()
+	s.indexes[key] = newSubnetIndex(subnets)
+	s.mu.Unlock()
+	return nil
+}
+
+// register records the provisioner behind a cluster name so the background refresh loop knows to
+// keep its index warm. It checks under RLock first, since on the hot Get() path the provisioner is
+// almost always already registered and unchanged; escalating to the exclusive Lock on every call
+// would serialize every concurrent Get() behind a write lock for no reason.
+func (s *SubnetProvider) register(provisioner *v1alpha1.Provisioner) {
+	clusterName := provisioner.Spec.Cluster.Name
+	s.mu.RLock()
+	existing, ok := s.provisioners[clusterName]
+	s.mu.RUnlock()
+	if ok && existing == provisioner {
+		return
 	}
-	// 2. Filter by subnet name if constrained
+	s.mu.Lock()
+	s.provisioners[clusterName] = provisioner
+	s.mu.Unlock()
+}
+
+func (s *SubnetProvider) getIndex(clusterName string) (*subnetIndex, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	index, ok := s.indexes[clusterName]
+	return index, ok
+}
+
+func (s *SubnetProvider) Get(ctx context.Context, provisioner *v1alpha1.Provisioner, constraints *Constraints) ([]*Subnet, error) {
+	s.register(provisioner)
+	// 1. Explicit SubnetIds or Names (ELB-annotation-style, comma-separated) bypass tag/VPC
+	// discovery entirely, since getExplicit already validates VPC membership itself, but they
+	// still go through the same zone-type/capacity filtering and ranking as discovered subnets.
+	if ids := constraints.GetSubnetIds(); len(ids) != 0 {
+		subnets, err := s.getExplicit(ctx, provisioner, explicitKindIDs, ids)
+		if err != nil {
+			return nil, err
+		}
+		return filterAndRank(subnets, provisioner, constraints), nil
+	}
+	if names := constraints.GetSubnetNames(); len(names) != 0 {
+		subnets, err := s.getExplicit(ctx, provisioner, explicitKindNames, names)
+		if err != nil {
+			return nil, err
+		}
+		return filterAndRank(subnets, provisioner, constraints), nil
+	}
+	// 2. Serve discovery entirely from the in-memory index, populating it synchronously on first use.
+	clusterName := provisioner.Spec.Cluster.Name
+	index, ok := s.getIndex(clusterName)
+	if !ok {
+		subnetCacheHits.WithLabelValues("false").Inc()
+		if err := s.Refresh(ctx, clusterName); err != nil {
+			return nil, err
+		}
+		index, _ = s.getIndex(clusterName)
+	} else {
+		subnetCacheHits.WithLabelValues("true").Inc()
+	}
+	subnets := index.all()
+	// 3. Filter by subnet name if constrained
 	if name := constraints.GetSubnetName(); name != nil {
 		subnets = filter(byName(aws.StringValue(name)), subnets)
 	}
-	// 3. Filter by subnet tag key if constrained
+	// 4. Filter by subnet tag key if constrained
 	if tagKey := constraints.GetSubnetTagKey(); tagKey != nil {
 		subnets = filter(byTagKey(*tagKey), subnets)
 	}
-	// 4. Filter by zones if constrained
+	// 5. Filter by arbitrary tag key/value pairs if constrained
+	if tags := constraints.GetSubnetTags(); len(tags) != 0 {
+		subnets = filter(byTags(tags), subnets)
+	}
+	// 6. Filter by VPC if constrained
+	if vpcID := constraints.GetVpcId(); vpcID != nil {
+		subnets = filter(byVpcID(aws.StringValue(vpcID)), subnets)
+	}
+	// 7. Filter by zones if constrained
 	if len(constraints.Zones) != 0 {
 		subnets = filter(byZones(constraints.Zones), subnets)
 	}
-	return subnets, nil
+	return filterAndRank(subnets, provisioner, constraints), nil
 }
 
-func (s *SubnetProvider) getSubnets(ctx context.Context, provisioner *v1alpha1.Provisioner) ([]*ec2.Subnet, error) {
-	if subnets, ok := s.cache.Get(provisioner.Spec.Cluster.Name); ok {
-		return subnets.([]*ec2.Subnet), nil
+// filterAndRank applies the zone-type and capacity filters, the onePerAZ tie-break, the
+// free-capacity ranking, and the low-IP warning shared by every Get() path (tag-discovered and
+// explicit SubnetId/Name alike).
+func filterAndRank(subnets []*Subnet, provisioner *v1alpha1.Provisioner, constraints *Constraints) []*Subnet {
+	// 8. Filter by zone type, defaulting to regular AvailabilityZones unless the provisioner has
+	// opted in to Local Zones, Wavelength Zones, or Outposts.
+	subnets = filter(byZoneType(zoneTypeConstraints(constraints)), subnets)
+	// 9. Drop subnets that can't fit the pending pods before tie-breaking or ranking, so an
+	// IP-exhausted tie-break winner doesn't shadow a sibling subnet in the same AZ that actually
+	// has room.
+	subnets = filter(byAvailableIPs(requiredIPAddresses(constraints)), subnets)
+	// 10. Tie-break down to one subnet per AZ if the provisioner asked for it. AvailableIpAddressCount
+	// is one of onePerAZ's own tie-break criteria, so it must run after the capacity filter above.
+	if constraints.GetSubnetSelectionPolicy() == SubnetSelectionPolicyOnePerAZ {
+		subnets = onePerAZ(subnets, provisioner.Spec.Cluster.Name)
 	}
+	// 11. Rank the survivors by free capacity so the launch template prefers the subnet with the
+	// most headroom.
+	sort.SliceStable(subnets, func(i, j int) bool {
+		return aws.Int64Value(subnets[i].AvailableIpAddressCount) > aws.Int64Value(subnets[j].AvailableIpAddressCount)
+	})
+	threshold := lowAvailableIPAddressThreshold(constraints)
+	for _, subnet := range subnets {
+		warnIfLowOnIPAddresses(subnet, threshold)
+	}
+	return subnets
+}
+
+// lowAvailableIPAddressThreshold returns the operator-configured threshold for the low-IP warning
+// and metric, falling back to DefaultLowAvailableIPAddressThreshold when unset.
+func lowAvailableIPAddressThreshold(constraints *Constraints) int64 {
+	if threshold := constraints.GetLowAvailableIPAddressThreshold(); threshold != nil {
+		return *threshold
+	}
+	return DefaultLowAvailableIPAddressThreshold
+}
+
+// zoneTypeConstraints returns the set of zone types Get() should return. Operators must opt in to
+// Local Zones, Wavelength Zones, and Outposts explicitly; by default only regular AZs are used,
+// since they have none of the instance type, connectivity, or gateway restrictions of the others.
+func zoneTypeConstraints(constraints *Constraints) []ZoneType {
+	if zoneTypes := constraints.GetZoneTypes(); len(zoneTypes) != 0 {
+		return zoneTypes
+	}
+	return []ZoneType{ZoneTypeAvailabilityZone}
+}
+
+// requiredIPAddresses estimates how many free IPv4 addresses a subnet needs to have available to
+// host the pending pods, not the pending pods times the ENI's full address capacity: the intended
+// instance type's secondary-IP-per-ENI count doubles as the number of pods it can host (one IP per
+// pod under the VPC CNI), so the number of new nodes needed is the pod count divided by that
+// capacity, rounded up, and each of those nodes consumes up to one primary plus its secondary IPs.
+func requiredIPAddresses(constraints *Constraints) int64 {
+	podCount := int64(constraints.GetPodCount())
+	if podCount < 1 {
+		podCount = 1
+	}
+	podsPerNode := int64(eniSecondaryIPsPerInstance(constraints.GetInstanceType()))
+	if podsPerNode < 1 {
+		podsPerNode = 1
+	}
+	nodesNeeded := (podCount + podsPerNode - 1) / podsPerNode
+	return nodesNeeded * (1 + podsPerNode)
+}
+
+// ipv4AddressesPerInterface is the EC2 "IPv4 addresses per interface" limit for instance types
+// Karpenter commonly launches. It's not exhaustive; instance types absent from the table fall
+// back to defaultIPv4AddressesPerInterface, the smallest limit of any current instance type, to
+// stay conservative rather than over-pack a subnet.
+var ipv4AddressesPerInterface = map[string]int{
+	"t3.nano":    2,
+	"t3.micro":   2,
+	"t3.small":   4,
+	"t3.medium":  6,
+	"t3.large":   12,
+	"t3.xlarge":  15,
+	"t3.2xlarge": 15,
+	"m5.large":   10,
+	"m5.xlarge":  15,
+	"m5.2xlarge": 15,
+	"m5.4xlarge": 30,
+	"c5.large":   10,
+	"c5.xlarge":  15,
+	"c5.2xlarge": 15,
+	"r5.large":   10,
+	"r5.xlarge":  15,
+	"r5.2xlarge": 15,
+}
+
+const defaultIPv4AddressesPerInterface = 2
+
+// eniSecondaryIPsPerInstance returns how many secondary IPv4 addresses a launch into the given
+// instance type consumes on its primary ENI (the limit minus the one address the instance itself
+// uses).
+func eniSecondaryIPsPerInstance(instanceType string) int {
+	addresses, ok := ipv4AddressesPerInterface[instanceType]
+	if !ok {
+		addresses = defaultIPv4AddressesPerInterface
+	}
+	return addresses - 1
+}
+
+func byAvailableIPs(minimum int64) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
+		return aws.Int64Value(subnet.AvailableIpAddressCount) >= minimum
+	}
+}
+
+func byZoneType(zoneTypes []ZoneType) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
+		for _, zoneType := range zoneTypes {
+			if subnet.ZoneType == zoneType {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func warnIfLowOnIPAddresses(subnet *Subnet, threshold int64) {
+	available := aws.Int64Value(subnet.AvailableIpAddressCount)
+	subnetID := aws.StringValue(subnet.SubnetId)
+	az := aws.StringValue(subnet.AvailabilityZone)
+	if available >= threshold {
+		subnetLowIPAddressCount.DeleteLabelValues(subnetID, az)
+		return
+	}
+	zap.S().Warnf("Subnet %s in %s has only %d free IP addresses remaining", subnetID, az, available)
+	subnetLowIPAddressCount.WithLabelValues(subnetID, az).Set(float64(available))
+}
+
+// InvalidateIfInsufficientAddresses inspects a launch error and, if it's
+// ErrCodeInsufficientFreeAddressesInSubnet, forces an immediate Refresh of the cluster's subnet
+// index so the next scheduling attempt sees updated AvailableIpAddressCount values rather than
+// waiting out the background refresh interval and retrying the same exhausted subnet.
+func (s *SubnetProvider) InvalidateIfInsufficientAddresses(ctx context.Context, err error, clusterName string) {
+	aerr, ok := err.(awserr.Error)
+	if !ok || aerr.Code() != ErrCodeInsufficientFreeAddressesInSubnet {
+		return
+	}
+	zap.S().Debugf("Refreshing subnets for cluster %s after %s", clusterName, ErrCodeInsufficientFreeAddressesInSubnet)
+	if err := s.Refresh(ctx, clusterName); err != nil {
+		zap.S().Errorf("Refreshing subnets for cluster %s, %v", clusterName, err)
+	}
+}
+
+// onePerAZ groups subnets by AvailabilityZone and picks a single winner per group, so a Provisioner
+// with both public and private subnets (or several private subnets) in the same AZ doesn't starve
+// nodes that happen to land in the "wrong" one. Ties are broken, in order, by: a role tag
+// (RoleTagKey or DiscoveryRoleTagKey), the cluster tag being "owned" rather than "shared", the most
+// AvailableIpAddressCount, and finally lexicographic SubnetId for a fully deterministic result.
+func onePerAZ(subnets []*Subnet, clusterName string) []*Subnet {
+	byAZ := map[string][]*Subnet{}
+	for _, subnet := range subnets {
+		az := aws.StringValue(subnet.AvailabilityZone)
+		byAZ[az] = append(byAZ[az], subnet)
+	}
+	result := make([]*Subnet, 0, len(byAZ))
+	for _, group := range byAZ {
+		sort.Slice(group, func(i, j int) bool {
+			return subnetLess(group[i], group[j], clusterName)
+		})
+		result = append(result, group[0])
+	}
+	return result
+}
+
+func subnetLess(a, b *Subnet, clusterName string) bool {
+	if hasRole, other := hasRoleTag(a), hasRoleTag(b); hasRole != other {
+		return hasRole
+	}
+	if owned, other := isOwned(a, clusterName), isOwned(b, clusterName); owned != other {
+		return owned
+	}
+	if ac, bc := aws.Int64Value(a.AvailableIpAddressCount), aws.Int64Value(b.AvailableIpAddressCount); ac != bc {
+		return ac > bc
+	}
+	return aws.StringValue(a.SubnetId) < aws.StringValue(b.SubnetId)
+}
+
+func hasRoleTag(subnet *Subnet) bool {
+	for _, tag := range subnet.Tags {
+		key := aws.StringValue(tag.Key)
+		if key == RoleTagKey || key == DiscoveryRoleTagKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isOwned(subnet *Subnet, clusterName string) bool {
+	return hasTag(subnet, fmt.Sprintf(ClusterTagKeyFormat, clusterName), "owned")
+}
+
+// getZoneTypes returns the in-memory AZ-name -> ZoneType mapping, populating it synchronously on
+// first use. DescribeAvailabilityZones isn't cluster-scoped, so the result is shared across every
+// provisioner and kept fresh by the same background refresh loop that reconciles subnet indexes.
+func (s *SubnetProvider) getZoneTypes(ctx context.Context) (map[string]ZoneType, error) {
+	s.mu.RLock()
+	zoneTypes := s.zoneTypes
+	s.mu.RUnlock()
+	if zoneTypes != nil {
+		return zoneTypes, nil
+	}
+	return s.refreshZoneTypes(ctx)
+}
+
+func (s *SubnetProvider) refreshZoneTypes(ctx context.Context) (map[string]ZoneType, error) {
+	output, err := s.ec2api.DescribeAvailabilityZonesWithContext(ctx, &ec2.DescribeAvailabilityZonesInput{
+		AllAvailabilityZones: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("describing availability zones, %w", err)
+	}
+	zoneTypes := map[string]ZoneType{}
+	for _, zone := range output.AvailabilityZones {
+		zoneTypes[aws.StringValue(zone.ZoneName)] = ZoneType(aws.StringValue(zone.ZoneType))
+	}
+	s.mu.Lock()
+	s.zoneTypes = zoneTypes
+	s.mu.Unlock()
+	return zoneTypes, nil
+}
+
+func wrapSubnets(subnets []*ec2.Subnet, zoneTypes map[string]ZoneType) []*Subnet {
+	wrapped := make([]*Subnet, 0, len(subnets))
+	for _, subnet := range subnets {
+		zoneType := zoneTypes[aws.StringValue(subnet.AvailabilityZone)]
+		wrapped = append(wrapped, &Subnet{
+			Subnet:            subnet,
+			ZoneType:          zoneType,
+			RequiresCarrierIP: zoneType == ZoneTypeWavelengthZone,
+		})
+	}
+	return wrapped
+}
+
+// getSubnetsByIds resolves an explicit SubnetId list, bypassing tag-based discovery. This is the
+// mechanism operators in shared/multi-tenant VPCs use when the kubernetes.io/cluster/<name> tag
+// can't be applied to subnets they don't own.
+func (s *SubnetProvider) getSubnetsByIds(ctx context.Context, provisioner *v1alpha1.Provisioner, ids []*string, zoneTypes map[string]ZoneType) ([]*Subnet, error) {
+	output, err := s.ec2api.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{SubnetIds: ids})
+	if err != nil {
+		return nil, fmt.Errorf("describing subnets by id, %w", err)
+	}
+	found := map[string]*ec2.Subnet{}
+	for _, subnet := range output.Subnets {
+		found[aws.StringValue(subnet.SubnetId)] = subnet
+	}
+	vpcID := aws.StringValue(provisioner.Spec.Cluster.VPCId)
+	for _, id := range ids {
+		subnet, ok := found[aws.StringValue(id)]
+		if !ok {
+			return nil, fmt.Errorf("subnet %s does not exist", aws.StringValue(id))
+		}
+		if vpcID != "" && aws.StringValue(subnet.VpcId) != vpcID {
+			return nil, fmt.Errorf("subnet %s belongs to vpc %s, not cluster vpc %s", aws.StringValue(id), aws.StringValue(subnet.VpcId), vpcID)
+		}
+	}
+	zap.S().Debugf("Successfully resolved %d subnets by id for cluster %s", len(output.Subnets), provisioner.Spec.Cluster.Name)
+	return wrapSubnets(output.Subnets, zoneTypes), nil
+}
+
+// getSubnetsByNames resolves an explicit Name-tag list, bypassing tag-based discovery. Mirrors
+// getSubnetsByIds, matching the AWS ELB annotation semantics where the subnet selector can name
+// subnets by id or by Name tag.
+func (s *SubnetProvider) getSubnetsByNames(ctx context.Context, provisioner *v1alpha1.Provisioner, names []*string, zoneTypes map[string]ZoneType) ([]*Subnet, error) {
 	output, err := s.ec2api.DescribeSubnetsWithContext(ctx, &ec2.DescribeSubnetsInput{Filters: []*ec2.Filter{{
-		Name:   aws.String("tag-key"), // Subnets must be tagged for the cluster
-		Values: []*string{aws.String(fmt.Sprintf(ClusterTagKeyFormat, provisioner.Spec.Cluster.Name))},
+		Name:   aws.String("tag:Name"),
+		Values: names,
 	}}})
 	if err != nil {
-		return nil, fmt.Errorf("describing subnets, %w", err)
+		return nil, fmt.Errorf("describing subnets by name, %w", err)
+	}
+	found := map[string]*ec2.Subnet{}
+	for _, subnet := range output.Subnets {
+		for _, tag := range subnet.Tags {
+			if aws.StringValue(tag.Key) == "Name" {
+				found[aws.StringValue(tag.Value)] = subnet
+			}
+		}
+	}
+	vpcID := aws.StringValue(provisioner.Spec.Cluster.VPCId)
+	for _, name := range names {
+		subnet, ok := found[aws.StringValue(name)]
+		if !ok {
+			return nil, fmt.Errorf("subnet named %s does not exist", aws.StringValue(name))
+		}
+		if vpcID != "" && aws.StringValue(subnet.VpcId) != vpcID {
+			return nil, fmt.Errorf("subnet named %s belongs to vpc %s, not cluster vpc %s", aws.StringValue(name), aws.StringValue(subnet.VpcId), vpcID)
+		}
 	}
-	zap.S().Debugf("Successfully discovered %d subnets for cluster %s", len(output.Subnets), provisioner.Spec.Cluster.Name)
-	s.cache.Set(provisioner.Spec.Cluster.Name, output.Subnets, CacheTTL)
-	return output.Subnets, nil
+	zap.S().Debugf("Successfully resolved %d subnets by name for cluster %s", len(output.Subnets), provisioner.Spec.Cluster.Name)
+	return wrapSubnets(output.Subnets, zoneTypes), nil
 }
 
-func filter(predicate func(*ec2.Subnet) bool, subnets []*ec2.Subnet) []*ec2.Subnet {
-	result := []*ec2.Subnet{}
+func filter(predicate func(*Subnet) bool, subnets []*Subnet) []*Subnet {
+	result := []*Subnet{}
 	for _, subnet := range subnets {
 		if predicate(subnet) {
 			result = append(result, subnet)
@@ -85,8 +741,8 @@ func filter(predicate func(*ec2.Subnet) bool, subnets []*ec2.Subnet) []*ec2.Subn
 	return result
 }
 
-func byName(name string) func(*ec2.Subnet) bool {
-	return func(subnet *ec2.Subnet) bool {
+func byName(name string) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
 		for _, tag := range subnet.Tags {
 			if aws.StringValue(tag.Key) == "Name" {
 				return aws.StringValue(tag.Value) == name
@@ -96,8 +752,8 @@ func byName(name string) func(*ec2.Subnet) bool {
 	}
 }
 
-func byTagKey(tagKey string) func(*ec2.Subnet) bool {
-	return func(subnet *ec2.Subnet) bool {
+func byTagKey(tagKey string) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
 		for _, tag := range subnet.Tags {
 			if aws.StringValue(tag.Key) == tagKey {
 				return true
@@ -107,8 +763,34 @@ func byTagKey(tagKey string) func(*ec2.Subnet) bool {
 	}
 }
 
-func byZones(zones []string) func(*ec2.Subnet) bool {
-	return func(subnet *ec2.Subnet) bool {
+func byTags(tags map[string]string) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
+		for key, value := range tags {
+			if !hasTag(subnet, key, value) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func hasTag(subnet *Subnet, key, value string) bool {
+	for _, tag := range subnet.Tags {
+		if aws.StringValue(tag.Key) == key && aws.StringValue(tag.Value) == value {
+			return true
+		}
+	}
+	return false
+}
+
+func byVpcID(vpcID string) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
+		return aws.StringValue(subnet.VpcId) == vpcID
+	}
+}
+
+func byZones(zones []string) func(*Subnet) bool {
+	return func(subnet *Subnet) bool {
 		for _, zone := range zones {
 			if aws.StringValue(subnet.AvailabilityZone) == zone {
 				return true
@@ -0,0 +1,386 @@
+/*
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/awslabs/karpenter/pkg/apis/provisioning/v1alpha1"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestEniSecondaryIPsPerInstance(t *testing.T) {
+	cases := []struct {
+		instanceType string
+		want         int
+	}{
+		{"t3.micro", 1},
+		{"m5.xlarge", 14},
+		{"some-instance-type-not-in-the-table", defaultIPv4AddressesPerInterface - 1},
+	}
+	for _, c := range cases {
+		if got := eniSecondaryIPsPerInstance(c.instanceType); got != c.want {
+			t.Errorf("eniSecondaryIPsPerInstance(%q) = %d, want %d", c.instanceType, got, c.want)
+		}
+	}
+}
+
+func TestByAvailableIPs(t *testing.T) {
+	subnets := []*Subnet{
+		testSubnet("subnet-a", "us-east-1a", 10),
+		testSubnet("subnet-b", "us-east-1a", 2),
+	}
+	got := filter(byAvailableIPs(5), subnets)
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-a" {
+		t.Errorf("byAvailableIPs(5) = %v, want only subnet-a", got)
+	}
+}
+
+func TestRequiredIPAddresses(t *testing.T) {
+	cases := []struct {
+		name         string
+		podCount     int
+		instanceType string
+		want         int64
+	}{
+		{"single pod on m5.xlarge fits within one node's ENI capacity", 1, "m5.xlarge", 15},
+		{"ten pods on m5.xlarge still fit on one node, not ten", 10, "m5.xlarge", 15},
+		{"fifteen pods on m5.xlarge need a second node", 15, "m5.xlarge", 30},
+		{"zero pod count defaults to a single pod", 0, "m5.xlarge", 15},
+	}
+	for _, c := range cases {
+		constraints := &Constraints{PodCount: c.podCount, InstanceType: c.instanceType}
+		if got := requiredIPAddresses(constraints); got != c.want {
+			t.Errorf("%s: requiredIPAddresses() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestWarnIfLowOnIPAddressesSetsGaugeBelowThreshold(t *testing.T) {
+	subnet := testSubnet("subnet-low", "us-east-1a", 1)
+	warnIfLowOnIPAddresses(subnet, DefaultLowAvailableIPAddressThreshold)
+	value := testutilGaugeValue(t, subnetLowIPAddressCount, "subnet-low", "us-east-1a")
+	if value != 1 {
+		t.Errorf("expected low-IP gauge to be set to 1, got %v", value)
+	}
+}
+
+func TestWarnIfLowOnIPAddressesClearsGaugeAboveThreshold(t *testing.T) {
+	subnet := testSubnet("subnet-healthy", "us-east-1b", 100)
+	warnIfLowOnIPAddresses(subnet, DefaultLowAvailableIPAddressThreshold)
+	if testutilGaugeExists(subnetLowIPAddressCount, "subnet-healthy", "us-east-1b") {
+		t.Error("expected low-IP gauge to be deleted once back above threshold")
+	}
+}
+
+func testutilGaugeValue(t *testing.T, vec *prometheus.GaugeVec, subnetID, az string) float64 {
+	t.Helper()
+	metric, ok := findGaugeMetric(vec, subnetID, az)
+	if !ok {
+		t.Fatalf("no gauge found for subnet %s az %s", subnetID, az)
+	}
+	return metric.GetGauge().GetValue()
+}
+
+func testutilGaugeExists(vec *prometheus.GaugeVec, subnetID, az string) bool {
+	_, ok := findGaugeMetric(vec, subnetID, az)
+	return ok
+}
+
+func findGaugeMetric(vec *prometheus.GaugeVec, subnetID, az string) (*dto.Metric, bool) {
+	ch := make(chan prometheus.Metric, 64)
+	vec.Collect(ch)
+	close(ch)
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if labels["subnet_id"] == subnetID && labels["availability_zone"] == az {
+			return &pb, true
+		}
+	}
+	return nil, false
+}
+
+func TestByZoneType(t *testing.T) {
+	az := &Subnet{Subnet: &ec2.Subnet{SubnetId: aws.String("subnet-az")}, ZoneType: ZoneTypeAvailabilityZone}
+	wavelength := &Subnet{Subnet: &ec2.Subnet{SubnetId: aws.String("subnet-wl")}, ZoneType: ZoneTypeWavelengthZone}
+	local := &Subnet{Subnet: &ec2.Subnet{SubnetId: aws.String("subnet-local")}, ZoneType: ZoneTypeLocalZone}
+
+	got := filter(byZoneType([]ZoneType{ZoneTypeAvailabilityZone}), []*Subnet{az, wavelength, local})
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-az" {
+		t.Errorf("byZoneType([AZ]) = %v, want only subnet-az", got)
+	}
+
+	got = filter(byZoneType([]ZoneType{ZoneTypeWavelengthZone, ZoneTypeLocalZone}), []*Subnet{az, wavelength, local})
+	if len(got) != 2 {
+		t.Errorf("byZoneType([Wavelength, Local]) = %v, want subnet-wl and subnet-local", got)
+	}
+}
+
+func TestWrapSubnetsSetsRequiresCarrierIPForWavelengthOnly(t *testing.T) {
+	zoneTypes := map[string]ZoneType{
+		"us-east-1-wl1-bos-wlz-1": ZoneTypeWavelengthZone,
+		"us-east-1a":              ZoneTypeAvailabilityZone,
+	}
+	raw := []*ec2.Subnet{
+		{SubnetId: aws.String("subnet-wl"), AvailabilityZone: aws.String("us-east-1-wl1-bos-wlz-1")},
+		{SubnetId: aws.String("subnet-az"), AvailabilityZone: aws.String("us-east-1a")},
+	}
+	wrapped := wrapSubnets(raw, zoneTypes)
+	for _, subnet := range wrapped {
+		wantCarrierIP := subnet.ZoneType == ZoneTypeWavelengthZone
+		if subnet.RequiresCarrierIP != wantCarrierIP {
+			t.Errorf("subnet %s: RequiresCarrierIP = %v, want %v", aws.StringValue(subnet.SubnetId), subnet.RequiresCarrierIP, wantCarrierIP)
+		}
+	}
+}
+
+func testSubnet(id, az string, availableIPs int64) *Subnet {
+	return &Subnet{
+		Subnet: &ec2.Subnet{
+			SubnetId:                aws.String(id),
+			AvailabilityZone:        aws.String(az),
+			AvailableIpAddressCount: aws.Int64(availableIPs),
+		},
+	}
+}
+
+func testSubnetWithTags(id, az string, availableIPs int64, tags map[string]string) *Subnet {
+	subnet := testSubnet(id, az, availableIPs)
+	for key, value := range tags {
+		subnet.Tags = append(subnet.Tags, &ec2.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return subnet
+}
+
+func TestOnePerAZPrefersRoleTag(t *testing.T) {
+	plain := testSubnet("subnet-plain", "us-east-1a", 100)
+	roleTagged := testSubnetWithTags("subnet-role", "us-east-1a", 5, map[string]string{RoleTagKey: ""})
+	got := onePerAZ([]*Subnet{plain, roleTagged}, "my-cluster")
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-role" {
+		t.Errorf("onePerAZ = %v, want subnet-role to win despite fewer free IPs", got)
+	}
+}
+
+func TestOnePerAZPrefersOwnedOverShared(t *testing.T) {
+	clusterTag := "kubernetes.io/cluster/my-cluster"
+	owned := testSubnetWithTags("subnet-owned", "us-east-1a", 5, map[string]string{clusterTag: "owned"})
+	shared := testSubnetWithTags("subnet-shared", "us-east-1a", 100, map[string]string{clusterTag: "shared"})
+	got := onePerAZ([]*Subnet{shared, owned}, "my-cluster")
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-owned" {
+		t.Errorf("onePerAZ = %v, want subnet-owned to win over subnet-shared", got)
+	}
+}
+
+func TestOnePerAZFallsBackToFreeIPsThenSubnetID(t *testing.T) {
+	a := testSubnet("subnet-a", "us-east-1a", 5)
+	b := testSubnet("subnet-b", "us-east-1a", 20)
+	got := onePerAZ([]*Subnet{a, b}, "my-cluster")
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-b" {
+		t.Errorf("onePerAZ = %v, want subnet-b (more free IPs)", got)
+	}
+
+	tie1 := testSubnet("subnet-z", "us-east-1b", 10)
+	tie2 := testSubnet("subnet-a", "us-east-1b", 10)
+	got = onePerAZ([]*Subnet{tie1, tie2}, "my-cluster")
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-a" {
+		t.Errorf("onePerAZ = %v, want lexicographically smallest SubnetId on a full tie", got)
+	}
+}
+
+func TestSubnetIndexAllIsDeterministic(t *testing.T) {
+	index := newSubnetIndex([]*Subnet{
+		testSubnet("subnet-c", "us-east-1a", 10),
+		testSubnet("subnet-a", "us-east-1a", 10),
+		testSubnet("subnet-b", "us-east-1a", 10),
+	})
+	want := []string{"subnet-a", "subnet-b", "subnet-c"}
+	for i := 0; i < 10; i++ {
+		if got := subnetIDs(index.all()); !stringSlicesEqual(got, want) {
+			t.Fatalf("all() = %v, want %v on every call", got, want)
+		}
+	}
+}
+
+func subnetIDs(subnets []*Subnet) []string {
+	ids := make([]string, len(subnets))
+	for i, subnet := range subnets {
+		ids[i] = aws.StringValue(subnet.SubnetId)
+	}
+	return ids
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// fakeEC2API overrides only the two calls SubnetProvider makes, leaving every other
+// ec2iface.EC2API method to panic if exercised.
+type fakeEC2API struct {
+	ec2iface.EC2API
+	subnets             []*ec2.Subnet
+	zones               []*ec2.AvailabilityZone
+	describeSubnetCalls int
+}
+
+func (f *fakeEC2API) DescribeSubnetsWithContext(_ aws.Context, _ *ec2.DescribeSubnetsInput, _ ...request.Option) (*ec2.DescribeSubnetsOutput, error) {
+	f.describeSubnetCalls++
+	return &ec2.DescribeSubnetsOutput{Subnets: f.subnets}, nil
+}
+
+func (f *fakeEC2API) DescribeAvailabilityZonesWithContext(_ aws.Context, _ *ec2.DescribeAvailabilityZonesInput, _ ...request.Option) (*ec2.DescribeAvailabilityZonesOutput, error) {
+	return &ec2.DescribeAvailabilityZonesOutput{AvailabilityZones: f.zones}, nil
+}
+
+func testProvider(fake *fakeEC2API) *SubnetProvider {
+	return &SubnetProvider{
+		ec2api:       fake,
+		indexes:      map[string]*subnetIndex{},
+		provisioners: map[string]*v1alpha1.Provisioner{},
+		explicit:     map[string]*explicitSelection{},
+		stopCh:       make(chan struct{}),
+	}
+}
+
+func TestSubnetProviderGetServesSecondCallFromIndex(t *testing.T) {
+	fake := &fakeEC2API{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-1"), AvailabilityZone: aws.String("us-east-1a"), AvailableIpAddressCount: aws.Int64(100)},
+		},
+		zones: []*ec2.AvailabilityZone{
+			{ZoneName: aws.String("us-east-1a"), ZoneType: aws.String(string(ZoneTypeAvailabilityZone))},
+		},
+	}
+	provider := testProvider(fake)
+	provisioner := &v1alpha1.Provisioner{Spec: v1alpha1.ProvisionerSpec{Cluster: v1alpha1.ClusterSpec{Name: "test-cluster"}}}
+
+	subnets, err := provider.Get(context.Background(), provisioner, &Constraints{})
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(subnets) != 1 || aws.StringValue(subnets[0].SubnetId) != "subnet-1" {
+		t.Fatalf("Get() = %v, want subnet-1", subnetIDs(subnets))
+	}
+
+	subnets, err = provider.Get(context.Background(), provisioner, &Constraints{})
+	if err != nil {
+		t.Fatalf("Get() (second call) error = %v", err)
+	}
+	if len(subnets) != 1 || aws.StringValue(subnets[0].SubnetId) != "subnet-1" {
+		t.Fatalf("Get() (second call) = %v, want subnet-1", subnetIDs(subnets))
+	}
+	if fake.describeSubnetCalls != 1 {
+		t.Errorf("DescribeSubnetsWithContext called %d times, want 1 (second Get() should be served from the index)", fake.describeSubnetCalls)
+	}
+}
+
+func TestSubnetProviderRefreshRepopulatesIndex(t *testing.T) {
+	fake := &fakeEC2API{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-1"), AvailabilityZone: aws.String("us-east-1a"), AvailableIpAddressCount: aws.Int64(5)},
+		},
+		zones: []*ec2.AvailabilityZone{
+			{ZoneName: aws.String("us-east-1a"), ZoneType: aws.String(string(ZoneTypeAvailabilityZone))},
+		},
+	}
+	provider := testProvider(fake)
+	if err := provider.Refresh(context.Background(), "test-cluster"); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	index, ok := provider.getIndex("test-cluster")
+	if !ok || len(index.all()) != 1 {
+		t.Fatalf("getIndex() after Refresh() = %v, %v, want a single-subnet index", index, ok)
+	}
+
+	fake.subnets = append(fake.subnets, &ec2.Subnet{SubnetId: aws.String("subnet-2"), AvailabilityZone: aws.String("us-east-1a"), AvailableIpAddressCount: aws.Int64(50)})
+	if err := provider.Refresh(context.Background(), "test-cluster"); err != nil {
+		t.Fatalf("Refresh() (second call) error = %v", err)
+	}
+	index, _ = provider.getIndex("test-cluster")
+	if len(index.all()) != 2 {
+		t.Errorf("getIndex() after second Refresh() has %d subnets, want 2", len(index.all()))
+	}
+}
+
+func TestSubnetProviderGetFiltersExplicitSubnetIdsByZoneType(t *testing.T) {
+	fake := &fakeEC2API{
+		subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-wl"), AvailabilityZone: aws.String("us-east-1-wl1-bos-wlz-1"), AvailableIpAddressCount: aws.Int64(100)},
+		},
+		zones: []*ec2.AvailabilityZone{
+			{ZoneName: aws.String("us-east-1-wl1-bos-wlz-1"), ZoneType: aws.String(string(ZoneTypeWavelengthZone))},
+		},
+	}
+	provider := testProvider(fake)
+	provisioner := &v1alpha1.Provisioner{Spec: v1alpha1.ProvisionerSpec{Cluster: v1alpha1.ClusterSpec{Name: "test-cluster"}}}
+	constraints := &Constraints{SubnetIds: []*string{aws.String("subnet-wl")}}
+
+	subnets, err := provider.Get(context.Background(), provisioner, constraints)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if len(subnets) != 0 {
+		t.Errorf("Get() with an explicit Wavelength-zone SubnetId and no zone-type opt-in = %v, want none: explicit selections must go through the same zone-type filter as discovered subnets", subnetIDs(subnets))
+	}
+}
+
+func TestOnePerAZTieBreakRunsAfterCapacityFilter(t *testing.T) {
+	tieBreakWinner := testSubnetWithTags("subnet-tiebreak-winner", "us-east-1a", 1, map[string]string{RoleTagKey: ""})
+	tieBreakWinner.ZoneType = ZoneTypeAvailabilityZone
+	capacityWinner := testSubnet("subnet-capacity-winner", "us-east-1a", 10)
+	capacityWinner.ZoneType = ZoneTypeAvailabilityZone
+
+	// Mirrors the relevant steps of Get(): filter by capacity before tie-breaking with onePerAZ,
+	// so a role-tagged tie-break winner that can't fit the workload doesn't shadow a sibling
+	// subnet in the same AZ that actually has room.
+	required := requiredIPAddresses(&Constraints{PodCount: 1, InstanceType: "t3.micro"}) // requires 2 free IPs
+	subnets := filter(byAvailableIPs(required), []*Subnet{tieBreakWinner, capacityWinner})
+	got := onePerAZ(subnets, "my-cluster")
+	if len(got) != 1 || aws.StringValue(got[0].SubnetId) != "subnet-capacity-winner" {
+		t.Fatalf("onePerAZ(byAvailableIPs(...)) = %v, want only subnet-capacity-winner: the role-tagged tie-break winner can't fit the workload and must be filtered out first", subnetIDs(got))
+	}
+}
+
+func TestOnePerAZGroupsByAvailabilityZone(t *testing.T) {
+	subnets := []*Subnet{
+		testSubnet("subnet-a1", "us-east-1a", 10),
+		testSubnet("subnet-a2", "us-east-1a", 5),
+		testSubnet("subnet-b1", "us-east-1b", 5),
+	}
+	got := onePerAZ(subnets, "my-cluster")
+	if len(got) != 2 {
+		t.Fatalf("onePerAZ returned %d subnets, want 1 per AZ (2 AZs)", len(got))
+	}
+}